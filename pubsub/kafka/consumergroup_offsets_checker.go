@@ -0,0 +1,77 @@
+// ------------------------------------------------------------
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+// ------------------------------------------------------------
+
+package kafka
+
+import (
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+)
+
+// waitForOffsets blocks until every partition in claims has a committed
+// consumer-group offset, or sarama can otherwise resolve the newest available
+// offset for it, polling at interval until timeout elapses. An error from the
+// coordinator lookup or the offset fetch ends the wait at once with that
+// error instead of being retried. This mirrors
+// Knative eventing-kafka's fix for event loss during subscription becoming
+// ready: signalling readiness as soon as Setup fires can race a rebalance
+// whose committed offsets haven't been initialized yet, silently dropping
+// messages published between subscribe-return and first consume.
+func waitForOffsets(client sarama.Client, group string, claims map[string][]int32, interval, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		ready, err := consumerGroupOffsetsReady(client, group, claims)
+		if err != nil {
+			return err
+		}
+		if ready {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.Errorf("kafka error: timed out after %s waiting for consumer group %q offsets to become available", timeout, group)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// consumerGroupOffsetsReady reports whether every (topic, partition) in claims
+// either has a committed offset for group, or its newest offset can be resolved.
+func consumerGroupOffsetsReady(client sarama.Client, group string, claims map[string][]int32) (bool, error) {
+	coordinator, err := client.Coordinator(group)
+	if err != nil {
+		return false, err
+	}
+
+	request := &sarama.OffsetFetchRequest{ConsumerGroup: group, Version: 1}
+	for topic, partitions := range claims {
+		for _, partition := range partitions {
+			request.AddPartition(topic, partition)
+		}
+	}
+
+	response, err := coordinator.FetchOffset(request)
+	if err != nil {
+		return false, err
+	}
+
+	for topic, partitions := range claims {
+		for _, partition := range partitions {
+			block := response.GetBlock(topic, partition)
+			if block == nil || block.Err != sarama.ErrNoError {
+				return false, nil
+			}
+			if block.Offset >= 0 {
+				continue
+			}
+			if _, err := client.GetOffset(topic, partition, sarama.OffsetNewest); err != nil {
+				return false, nil
+			}
+		}
+	}
+
+	return true, nil
+}
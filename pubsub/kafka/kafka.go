@@ -7,39 +7,190 @@ package kafka
 
 import (
 	"context"
-	"os"
-	"os/signal"
+	"crypto/tls"
+	"crypto/x509"
+	"strconv"
 	"strings"
 	"sync"
-	"syscall"
+	"time"
 
 	"github.com/Shopify/sarama"
 	log "github.com/Sirupsen/logrus"
 	"github.com/dapr/components-contrib/pubsub"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultOffsetCheckInterval = 500 * time.Millisecond
+	defaultOffsetCheckTimeout  = 30 * time.Second
 )
 
 // Kafka allows reading/writing to a Kafka consumer group
 type Kafka struct {
 	producer      sarama.SyncProducer
-	topics        []string
 	consumerGroup string
 	brokers       []string
+	metadata      *kafkaMetadata
+
+	consumerBuilder ConsumerBuilder
+	producerBuilder ProducerBuilder
+	clientBuilder   ClientBuilder
+
+	lock           sync.Mutex
+	wg             sync.WaitGroup
+	cancel         map[string]context.CancelFunc
+	consumerGroups map[string]sarama.ConsumerGroup
+	offsetClients  map[string]sarama.Client
+}
+
+// ConsumerBuilder builds the sarama.ConsumerGroup used by Subscribe, allowing callers
+// to inject fakes in tests or customize how the consumer group client is constructed.
+type ConsumerBuilder func(brokers []string, group string, config *sarama.Config) (sarama.ConsumerGroup, error)
+
+// ProducerBuilder builds the sarama.SyncProducer used by Publish, allowing callers
+// to inject fakes in tests or customize how the producer client is constructed.
+type ProducerBuilder func(brokers []string, config *sarama.Config) (sarama.SyncProducer, error)
+
+// ClientBuilder builds the sarama.Client used to verify consumer group offsets
+// before Subscribe signals readiness, allowing callers to inject fakes in tests.
+type ClientBuilder func(brokers []string, config *sarama.Config) (sarama.Client, error)
+
+func defaultConsumerBuilder(brokers []string, group string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+	return sarama.NewConsumerGroup(brokers, group, config)
+}
+
+func defaultProducerBuilder(brokers []string, config *sarama.Config) (sarama.SyncProducer, error) {
+	return sarama.NewSyncProducer(brokers, config)
+}
+
+func defaultClientBuilder(brokers []string, config *sarama.Config) (sarama.Client, error) {
+	return sarama.NewClient(brokers, config)
 }
 
+const (
+	saslMechanismPlaintext   = "PLAIN"
+	saslMechanismSCRAMSHA256 = "SCRAM-SHA-256"
+	saslMechanismSCRAMSHA512 = "SCRAM-SHA-512"
+)
+
+const (
+	partitionerRandom     = "random"
+	partitionerRoundRobin = "roundrobin"
+	partitionerHash       = "hash"
+	partitionerManual     = "manual"
+)
+
+const (
+	requiredAcksNone  = "none"
+	requiredAcksLocal = "local"
+	requiredAcksAll   = "all"
+)
+
+const (
+	compressionNone   = "none"
+	compressionGzip   = "gzip"
+	compressionSnappy = "snappy"
+	compressionLZ4    = "lz4"
+	compressionZstd   = "zstd"
+)
+
+const (
+	// ceHeaderPrefix marks a PublishRequest metadata entry as a CloudEvents
+	// binary-mode header to forward onto the produced Kafka record.
+	ceHeaderPrefix = "ce_"
+
+	metadataKeyField       = "key"
+	metadataPartitionField = "partition"
+)
+
 type kafkaMetadata struct {
 	Brokers       []string `json:"brokers"`
 	Topics        []string `json:"topics"`
 	PublishTopic  string   `json:"publishTopic"`
 	ConsumerGroup string   `json:"consumerGroup"`
+
+	TopicMapping string `json:"topicMapping"`
+	topicMapping map[string]string
+
+	AuthRequired  bool   `json:"authRequired"`
+	SaslUsername  string `json:"saslUsername"`
+	SaslPassword  string `json:"saslPassword"`
+	SaslMechanism string `json:"saslMechanism"`
+
+	TLSEnable     bool   `json:"tlsEnable"`
+	TLSSkipVerify bool   `json:"tlsSkipVerify"`
+	CaCert        string `json:"caCert"`
+	ClientCert    string `json:"clientCert"`
+	ClientKey     string `json:"clientKey"`
+
+	Version      string `json:"version"`
+	kafkaVersion sarama.KafkaVersion
+
+	Partitioner     string `json:"partitioner"`
+	RequiredAcks    string `json:"requiredAcks"`
+	MaxMessageBytes string `json:"maxMessageBytes"`
+	Compression     string `json:"compression"`
+
+	OffsetCheckInterval string `json:"offsetCheckInterval"`
+	OffsetCheckTimeout  string `json:"offsetCheckTimeout"`
+	offsetCheckInterval time.Duration
+	offsetCheckTimeout  time.Duration
 }
 
+// offsetsCheckerFunc waits for the offsets of the claimed partitions to become
+// available; consumer.checkOffsets defaults to waitForOffsets and is
+// overridable in tests.
+type offsetsCheckerFunc func(client sarama.Client, group string, claims map[string][]int32, interval, timeout time.Duration) error
+
 type consumer struct {
+	readyMu  sync.Mutex
 	ready    chan bool
 	callback func(msg *pubsub.NewMessage) error
+
+	offsetClient        sarama.Client
+	consumerGroup       string
+	offsetCheckInterval time.Duration
+	offsetCheckTimeout  time.Duration
+	checkOffsets        offsetsCheckerFunc
+
+	// setupErr carries the first Setup call's offset-check failure back to
+	// Subscribe, so it can return an error instead of retrying forever in the
+	// background. Buffered so Setup never blocks on it; later generations'
+	// failures are only logged.
+	setupErr chan error
 }
 
-func (consumer *consumer) Setup(sarama.ConsumerGroupSession) error {
-	close(consumer.ready)
+// Setup is called at the beginning of every generation of the consumer group's
+// session. Before signalling readiness it waits for the assigned partitions'
+// committed offsets to become available, so that a rebalance racing the
+// caller's first publish doesn't silently drop messages. Rebalances can drive
+// Setup/Cleanup multiple times within a single client.Consume call, so closing
+// consumer.ready is guarded against double-close.
+func (consumer *consumer) Setup(session sarama.ConsumerGroupSession) error {
+	if consumer.offsetClient != nil || consumer.checkOffsets != nil {
+		check := consumer.checkOffsets
+		if check == nil {
+			check = waitForOffsets
+		}
+		if err := check(consumer.offsetClient, consumer.consumerGroup, session.Claims(), consumer.offsetCheckInterval, consumer.offsetCheckTimeout); err != nil {
+			if consumer.setupErr != nil {
+				select {
+				case consumer.setupErr <- err:
+				default:
+				}
+			}
+			return err
+		}
+	}
+
+	consumer.readyMu.Lock()
+	defer consumer.readyMu.Unlock()
+	select {
+	case <-consumer.ready:
+		// already signalled for this generation
+	default:
+		close(consumer.ready)
+	}
 	return nil
 }
 
@@ -47,8 +198,9 @@ func (consumer *consumer) ConsumeClaim(session sarama.ConsumerGroupSession, clai
 	for message := range claim.Messages() {
 		if consumer.callback != nil {
 			err := consumer.callback(&pubsub.NewMessage{
-				Topic: claim.Topic(),
-				Data:  message.Value,
+				Topic:    claim.Topic(),
+				Data:     message.Value,
+				Metadata: recordMetadata(message),
 			})
 			if err == nil {
 				session.MarkMessage(message, "")
@@ -58,13 +210,61 @@ func (consumer *consumer) ConsumeClaim(session sarama.ConsumerGroupSession, clai
 	return nil
 }
 
+// Cleanup runs after each generation ends and resets ready so the next
+// generation's Setup call signals readiness again.
 func (consumer *consumer) Cleanup(sarama.ConsumerGroupSession) error {
+	consumer.readyMu.Lock()
+	defer consumer.readyMu.Unlock()
+	consumer.ready = make(chan bool)
 	return nil
 }
 
+// recordMetadata surfaces a Kafka record's key, partition, offset, timestamp
+// and headers on the delivered pubsub.NewMessage, since consumer.callback
+// only sees Topic/Data/Metadata.
+func recordMetadata(message *sarama.ConsumerMessage) map[string]string {
+	metadata := map[string]string{
+		metadataPartitionField: strconv.Itoa(int(message.Partition)),
+		"offset":               strconv.FormatInt(message.Offset, 10),
+		"timestamp":            message.Timestamp.Format(time.RFC3339),
+	}
+	if len(message.Key) > 0 {
+		metadata[metadataKeyField] = string(message.Key)
+	}
+	for _, header := range message.Headers {
+		metadata[string(header.Key)] = string(header.Value)
+	}
+	return metadata
+}
+
 // NewKafka returns a new kafka pubsub instance
 func NewKafka() pubsub.PubSub {
-	return &Kafka{}
+	return &Kafka{
+		consumerBuilder: defaultConsumerBuilder,
+		producerBuilder: defaultProducerBuilder,
+		clientBuilder:   defaultClientBuilder,
+	}
+}
+
+// WithConsumerBuilder overrides the ConsumerBuilder used to construct the consumer
+// group client, e.g. to inject a fake in tests.
+func (k *Kafka) WithConsumerBuilder(builder ConsumerBuilder) *Kafka {
+	k.consumerBuilder = builder
+	return k
+}
+
+// WithProducerBuilder overrides the ProducerBuilder used to construct the producer
+// client, e.g. to inject a fake in tests.
+func (k *Kafka) WithProducerBuilder(builder ProducerBuilder) *Kafka {
+	k.producerBuilder = builder
+	return k
+}
+
+// WithClientBuilder overrides the ClientBuilder used to construct the sarama.Client
+// that verifies consumer group offsets, e.g. to inject a fake in tests.
+func (k *Kafka) WithClientBuilder(builder ClientBuilder) *Kafka {
+	k.clientBuilder = builder
+	return k
 }
 
 // Init does metadata parsing and connection establishment
@@ -74,24 +274,60 @@ func (k *Kafka) Init(metadata pubsub.Metadata) error {
 		return err
 	}
 
+	if len(meta.Brokers) == 0 {
+		return errors.New("kafka error: missing 'brokers' attribute")
+	}
+
 	p, err := k.getSyncProducer(meta)
 	if err != nil {
 		return err
 	}
 
+	k.metadata = meta
 	k.brokers = meta.Brokers
 	k.producer = p
-	k.topics = meta.Topics
 	k.consumerGroup = meta.ConsumerGroup
 	return nil
 }
 
-// Publish message to Kafka cluster
+// Publish message to Kafka cluster. The destination topic is req.Topic, unless
+// an explicit topicMapping entry remaps it; the publishTopic metadata property
+// is used only when req.Topic is empty and has no mapping. req.Metadata may carry a "key", a "partition" (used verbatim with the
+// manual partitioner), and any number of "ce_"-prefixed CloudEvents headers,
+// all of which are set on the produced record.
 func (k *Kafka) Publish(req *pubsub.PublishRequest) error {
-	_, _, err := k.producer.SendMessage(&sarama.ProducerMessage{
-		Topic: req.Topic,
+	topic := req.Topic
+	if mapped, ok := k.metadata.topicMapping[req.Topic]; ok {
+		topic = mapped
+	} else if topic == "" {
+		topic = k.metadata.PublishTopic
+	}
+	if topic == "" {
+		return errors.New("kafka error: publish topic not specified")
+	}
+
+	msg := &sarama.ProducerMessage{
+		Topic: topic,
 		Value: sarama.ByteEncoder(req.Data),
-	})
+	}
+
+	if key, ok := req.Metadata[metadataKeyField]; ok && key != "" {
+		msg.Key = sarama.StringEncoder(key)
+	}
+	if val, ok := req.Metadata[metadataPartitionField]; ok && val != "" {
+		partition, err := strconv.ParseInt(val, 10, 32)
+		if err != nil {
+			return errors.Wrap(err, "kafka error: invalid partition metadata")
+		}
+		msg.Partition = int32(partition)
+	}
+	for metaKey, metaVal := range req.Metadata {
+		if strings.HasPrefix(metaKey, ceHeaderPrefix) {
+			msg.Headers = append(msg.Headers, sarama.RecordHeader{Key: []byte(metaKey), Value: []byte(metaVal)})
+		}
+	}
+
+	_, _, err := k.producer.SendMessage(msg)
 	if err != nil {
 		return err
 	}
@@ -99,52 +335,158 @@ func (k *Kafka) Publish(req *pubsub.PublishRequest) error {
 	return nil
 }
 
-// Subscribe to topic in the Kafka cluser
+// Subscribe to topic in the Kafka cluster. Subscribe starts the consume loop
+// in a background goroutine, but first waits for the consumer group's first
+// Setup to either signal readiness or fail its offset check (the check itself
+// is bounded by offsetCheckTimeout; the wait for Setup to run has no bound of
+// its own), returning that failure to the caller so it can retry; once
+// ready, further rebalances are handled entirely in the background. The Dapr
+// runtime owns process lifecycle and signal handling, not this component;
+// call Close to shut the subscription down.
 func (k *Kafka) Subscribe(req pubsub.SubscribeRequest, handler func(msg *pubsub.NewMessage) error) error {
+	config, err := newSaramaConfig(k.metadata)
+	if err != nil {
+		return err
+	}
 
-	config := sarama.NewConfig()
-	config.Version = sarama.V1_0_0_0
-
-	cs := consumer{
-		callback: handler,
-		ready:    make(chan bool),
+	// Build the offset-check client before the consumer group client so a
+	// failure here doesn't leak the consumer group's broker connections.
+	offsetClient, err := k.clientBuilder(k.brokers, config)
+	if err != nil {
+		return err
 	}
 
-	client, err := sarama.NewConsumerGroup(k.brokers, k.consumerGroup, config)
+	client, err := k.consumerBuilder(k.brokers, k.consumerGroup, config)
 	if err != nil {
+		if offsetClient != nil {
+			offsetClient.Close()
+		}
 		return err
 	}
 
+	cs := consumer{
+		callback:            handler,
+		ready:               make(chan bool),
+		setupErr:            make(chan error, 1),
+		offsetClient:        offsetClient,
+		consumerGroup:       k.consumerGroup,
+		offsetCheckInterval: k.metadata.offsetCheckInterval,
+		offsetCheckTimeout:  k.metadata.offsetCheckTimeout,
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
+	k.lock.Lock()
+	if _, exists := k.cancel[req.Topic]; exists {
+		k.lock.Unlock()
+		cancel()
+		client.Close()
+		if offsetClient != nil {
+			offsetClient.Close()
+		}
+		return errors.Errorf("kafka error: already subscribed to topic %s", req.Topic)
+	}
+	if k.cancel == nil {
+		k.cancel = make(map[string]context.CancelFunc)
+	}
+	if k.consumerGroups == nil {
+		k.consumerGroups = make(map[string]sarama.ConsumerGroup)
+	}
+	if k.offsetClients == nil {
+		k.offsetClients = make(map[string]sarama.Client)
+	}
+	k.cancel[req.Topic] = cancel
+	k.consumerGroups[req.Topic] = client
+	k.offsetClients[req.Topic] = offsetClient
+	k.lock.Unlock()
+
+	k.wg.Add(1)
 	go func() {
-		defer wg.Done()
+		defer k.wg.Done()
 		for {
-			if err = client.Consume(ctx, k.topics, &cs); err != nil {
+			if err := client.Consume(ctx, []string{req.Topic}, &cs); err != nil {
 				log.Errorf("error from consumer: %s", err)
 			}
 			// check if context was cancelled, signaling that the consumer should stop
 			if ctx.Err() != nil {
 				return
 			}
-			cs.ready = make(chan bool)
 		}
 	}()
 
-	<-cs.ready
+	select {
+	case <-cs.ready:
+		return nil
+	case err := <-cs.setupErr:
+		cancel()
+		k.removeSubscription(req.Topic)
+		return errors.Wrap(err, "kafka error: subscription never became ready")
+	}
+}
+
+// removeSubscription drops topic's tracked cancel func and clients, closing
+// the consumer group and offset client so a failed Subscribe doesn't leak
+// them.
+func (k *Kafka) removeSubscription(topic string) {
+	k.lock.Lock()
+	cg := k.consumerGroups[topic]
+	oc := k.offsetClients[topic]
+	delete(k.cancel, topic)
+	delete(k.consumerGroups, topic)
+	delete(k.offsetClients, topic)
+	k.lock.Unlock()
 
-	sigterm := make(chan os.Signal, 1)
-	signal.Notify(sigterm, syscall.SIGINT, syscall.SIGTERM)
-	<-sigterm
-	cancel()
-	wg.Wait()
-	if err = client.Close(); err != nil {
-		return err
+	if cg != nil {
+		if err := cg.Close(); err != nil {
+			log.Errorf("kafka error: closing consumer group for topic %s: %s", topic, err)
+		}
+	}
+	if oc != nil && !oc.Closed() {
+		if err := oc.Close(); err != nil {
+			log.Errorf("kafka error: closing offset client for topic %s: %s", topic, err)
+		}
+	}
+}
+
+// Close shuts every active subscription down: it cancels their contexts,
+// waits for the consume loops to exit, then closes the producer and every
+// consumer group client.
+func (k *Kafka) Close() error {
+	k.lock.Lock()
+	for _, cancel := range k.cancel {
+		cancel()
+	}
+	k.lock.Unlock()
+
+	k.wg.Wait()
+
+	var errs []string
+	if k.producer != nil {
+		if err := k.producer.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	for topic, cg := range k.consumerGroups {
+		if err := cg.Close(); err != nil {
+			errs = append(errs, errors.Wrapf(err, "kafka error: closing consumer group for topic %s", topic).Error())
+		}
+	}
+	for topic, oc := range k.offsetClients {
+		if oc == nil || oc.Closed() {
+			continue
+		}
+		if err := oc.Close(); err != nil {
+			errs = append(errs, errors.Wrapf(err, "kafka error: closing offset client for topic %s", topic).Error())
+		}
 	}
-	return nil
 
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
 }
 
 // getKafkaMetadata returns new Kafka metadata
@@ -158,18 +500,266 @@ func (k *Kafka) getKafkaMetadata(metadata pubsub.Metadata) (*kafkaMetadata, erro
 	if val, ok := metadata.Properties["topics"]; ok && val != "" {
 		meta.Topics = strings.Split(val, ",")
 	}
+	meta.PublishTopic = metadata.Properties["publishTopic"]
+
+	if val, ok := metadata.Properties["topicMapping"]; ok && val != "" {
+		meta.TopicMapping = val
+		meta.topicMapping = make(map[string]string)
+		for _, pair := range strings.Split(val, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+				return nil, errors.Errorf("kafka error: invalid topicMapping entry %q, expected dapr=kafka", pair)
+			}
+			meta.topicMapping[kv[0]] = kv[1]
+		}
+	}
+
+	if val, ok := metadata.Properties["authRequired"]; ok && val != "" {
+		authRequired, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, errors.Wrap(err, "kafka error: invalid value for authRequired")
+		}
+		meta.AuthRequired = authRequired
+	}
+	meta.SaslUsername = metadata.Properties["saslUsername"]
+	meta.SaslPassword = metadata.Properties["saslPassword"]
+	meta.SaslMechanism = metadata.Properties["saslMechanism"]
+	if meta.AuthRequired {
+		if meta.SaslUsername == "" {
+			return nil, errors.New("kafka error: missing SASL Username for authRequired")
+		}
+		if meta.SaslPassword == "" {
+			return nil, errors.New("kafka error: missing SASL Password for authRequired")
+		}
+		if meta.SaslMechanism == "" {
+			meta.SaslMechanism = saslMechanismPlaintext
+		}
+	}
+	switch meta.SaslMechanism {
+	case "", saslMechanismPlaintext, saslMechanismSCRAMSHA256, saslMechanismSCRAMSHA512:
+	default:
+		return nil, errors.Errorf("kafka error: unsupported saslMechanism %q", meta.SaslMechanism)
+	}
+
+	if val, ok := metadata.Properties["tlsEnable"]; ok && val != "" {
+		tlsEnable, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, errors.Wrap(err, "kafka error: invalid value for tlsEnable")
+		}
+		meta.TLSEnable = tlsEnable
+	}
+	if val, ok := metadata.Properties["tlsSkipVerify"]; ok && val != "" {
+		tlsSkipVerify, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, errors.Wrap(err, "kafka error: invalid value for tlsSkipVerify")
+		}
+		meta.TLSSkipVerify = tlsSkipVerify
+	}
+	meta.CaCert = metadata.Properties["caCert"]
+	meta.ClientCert = metadata.Properties["clientCert"]
+	meta.ClientKey = metadata.Properties["clientKey"]
+	if (meta.ClientCert != "") != (meta.ClientKey != "") {
+		return nil, errors.New("kafka error: clientCert and clientKey must both be set")
+	}
+
+	meta.kafkaVersion = sarama.V1_0_0_0
+	if val, ok := metadata.Properties["version"]; ok && val != "" {
+		version, err := sarama.ParseKafkaVersion(val)
+		if err != nil {
+			return nil, errors.Wrap(err, "kafka error: invalid kafka version")
+		}
+		meta.Version = val
+		meta.kafkaVersion = version
+	}
+
+	meta.Partitioner = metadata.Properties["partitioner"]
+	switch meta.Partitioner {
+	case "", partitionerRandom, partitionerRoundRobin, partitionerHash, partitionerManual:
+	default:
+		return nil, errors.Errorf("kafka error: unsupported partitioner %q", meta.Partitioner)
+	}
+
+	meta.RequiredAcks = metadata.Properties["requiredAcks"]
+	switch meta.RequiredAcks {
+	case "", requiredAcksNone, requiredAcksLocal, requiredAcksAll:
+	default:
+		return nil, errors.Errorf("kafka error: unsupported requiredAcks %q", meta.RequiredAcks)
+	}
+
+	if val, ok := metadata.Properties["maxMessageBytes"]; ok && val != "" {
+		if _, err := strconv.Atoi(val); err != nil {
+			return nil, errors.Wrap(err, "kafka error: invalid value for maxMessageBytes")
+		}
+		meta.MaxMessageBytes = val
+	}
+
+	meta.Compression = metadata.Properties["compression"]
+	switch meta.Compression {
+	case "", compressionNone, compressionGzip, compressionSnappy, compressionLZ4, compressionZstd:
+	default:
+		return nil, errors.Errorf("kafka error: unsupported compression %q", meta.Compression)
+	}
+
+	meta.offsetCheckInterval = defaultOffsetCheckInterval
+	if val, ok := metadata.Properties["offsetCheckInterval"]; ok && val != "" {
+		interval, err := time.ParseDuration(val)
+		if err != nil {
+			return nil, errors.Wrap(err, "kafka error: invalid value for offsetCheckInterval")
+		}
+		meta.OffsetCheckInterval = val
+		meta.offsetCheckInterval = interval
+	}
+	meta.offsetCheckTimeout = defaultOffsetCheckTimeout
+	if val, ok := metadata.Properties["offsetCheckTimeout"]; ok && val != "" {
+		timeout, err := time.ParseDuration(val)
+		if err != nil {
+			return nil, errors.Wrap(err, "kafka error: invalid value for offsetCheckTimeout")
+		}
+		meta.OffsetCheckTimeout = val
+		meta.offsetCheckTimeout = timeout
+	}
+
 	return &meta, nil
 }
 
 func (k *Kafka) getSyncProducer(meta *kafkaMetadata) (sarama.SyncProducer, error) {
-	config := sarama.NewConfig()
+	config, err := newSaramaConfig(meta)
+	if err != nil {
+		return nil, err
+	}
 	config.Producer.RequiredAcks = sarama.WaitForAll
 	config.Producer.Retry.Max = 5
 	config.Producer.Return.Successes = true
 
-	producer, err := sarama.NewSyncProducer(meta.Brokers, config)
+	if err := updateProducerConfig(config, meta); err != nil {
+		return nil, err
+	}
+
+	producer, err := k.producerBuilder(meta.Brokers, config)
 	if err != nil {
 		return nil, err
 	}
 	return producer, nil
 }
+
+// updateProducerConfig applies the optional partitioner, requiredAcks,
+// maxMessageBytes and compression metadata properties to config.
+func updateProducerConfig(config *sarama.Config, meta *kafkaMetadata) error {
+	switch meta.Partitioner {
+	case partitionerRandom:
+		config.Producer.Partitioner = sarama.NewRandomPartitioner
+	case partitionerRoundRobin:
+		config.Producer.Partitioner = sarama.NewRoundRobinPartitioner
+	case partitionerHash:
+		config.Producer.Partitioner = sarama.NewHashPartitioner
+	case partitionerManual:
+		config.Producer.Partitioner = sarama.NewManualPartitioner
+	}
+
+	switch meta.RequiredAcks {
+	case requiredAcksNone:
+		config.Producer.RequiredAcks = sarama.NoResponse
+	case requiredAcksLocal:
+		config.Producer.RequiredAcks = sarama.WaitForLocal
+	case requiredAcksAll:
+		config.Producer.RequiredAcks = sarama.WaitForAll
+	}
+
+	if meta.MaxMessageBytes != "" {
+		maxMessageBytes, err := strconv.Atoi(meta.MaxMessageBytes)
+		if err != nil {
+			return errors.Wrap(err, "kafka error: invalid value for maxMessageBytes")
+		}
+		config.Producer.MaxMessageBytes = maxMessageBytes
+	}
+
+	switch meta.Compression {
+	case "", compressionNone:
+		config.Producer.Compression = sarama.CompressionNone
+	case compressionGzip:
+		config.Producer.Compression = sarama.CompressionGZIP
+	case compressionSnappy:
+		config.Producer.Compression = sarama.CompressionSnappy
+	case compressionLZ4:
+		config.Producer.Compression = sarama.CompressionLZ4
+	case compressionZstd:
+		config.Producer.Compression = sarama.CompressionZSTD
+	}
+
+	return nil
+}
+
+// newSaramaConfig builds the sarama.Config shared by the producer and consumer
+// group clients, applying the configured Kafka version, TLS and SASL settings.
+func newSaramaConfig(meta *kafkaMetadata) (*sarama.Config, error) {
+	config := sarama.NewConfig()
+	config.Version = meta.kafkaVersion
+
+	if err := updateTLSConfig(config, meta); err != nil {
+		return nil, err
+	}
+	if err := updateAuthInfo(config, meta); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// updateAuthInfo configures SASL authentication (PLAIN or SCRAM) on config from meta.
+func updateAuthInfo(config *sarama.Config, meta *kafkaMetadata) error {
+	if !meta.AuthRequired {
+		return nil
+	}
+
+	config.Net.SASL.Enable = true
+	config.Net.SASL.User = meta.SaslUsername
+	config.Net.SASL.Password = meta.SaslPassword
+
+	switch meta.SaslMechanism {
+	case saslMechanismSCRAMSHA256:
+		config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{HashGeneratorFcn: sha256ClientGenerator}
+		}
+	case saslMechanismSCRAMSHA512:
+		config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{HashGeneratorFcn: sha512ClientGenerator}
+		}
+	case saslMechanismPlaintext:
+		config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	}
+
+	return nil
+}
+
+// updateTLSConfig configures TLS on config, loading the optional CA/client certificates from meta.
+func updateTLSConfig(config *sarama.Config, meta *kafkaMetadata) error {
+	if !meta.TLSEnable {
+		return nil
+	}
+
+	config.Net.TLS.Enable = true
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: meta.TLSSkipVerify, //nolint:gosec
+	}
+
+	if meta.CaCert != "" {
+		caCertPool := x509.NewCertPool()
+		if ok := caCertPool.AppendCertsFromPEM([]byte(meta.CaCert)); !ok {
+			return errors.New("kafka error: unable to parse caCert PEM")
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+
+	if meta.ClientCert != "" && meta.ClientKey != "" {
+		cert, err := tls.X509KeyPair([]byte(meta.ClientCert), []byte(meta.ClientKey))
+		if err != nil {
+			return errors.Wrap(err, "kafka error: unable to load client certificate/key pair")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	config.Net.TLS.Config = tlsConfig
+	return nil
+}
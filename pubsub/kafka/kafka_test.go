@@ -6,9 +6,19 @@
 package kafka
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
 	"testing"
+	"time"
 
+	"github.com/Shopify/sarama"
 	"github.com/dapr/components-contrib/pubsub"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -22,3 +32,747 @@ func TestParseMetadata(t *testing.T) {
 	assert.Equal(t, "a", meta.ConsumerGroup)
 	assert.Equal(t, "a", meta.Topics[0])
 }
+
+func TestParseMetadataWithPublishTopicAndMapping(t *testing.T) {
+	m := pubsub.Metadata{}
+	m.Properties = map[string]string{
+		"consumerGroup": "a", "brokers": "a", "topics": "a",
+		"publishTopic": "orders", "topicMapping": "orders=orders-v2,returns=returns-v2",
+	}
+	k := Kafka{}
+	meta, err := k.getKafkaMetadata(m)
+	assert.Nil(t, err)
+	assert.Equal(t, "orders", meta.PublishTopic)
+	assert.Equal(t, "orders-v2", meta.topicMapping["orders"])
+	assert.Equal(t, "returns-v2", meta.topicMapping["returns"])
+}
+
+func TestParseMetadataWithInvalidTopicMapping(t *testing.T) {
+	m := pubsub.Metadata{}
+	m.Properties = map[string]string{
+		"consumerGroup": "a", "brokers": "a", "topics": "a",
+		"topicMapping": "orders-v2",
+	}
+	k := Kafka{}
+	_, err := k.getKafkaMetadata(m)
+	assert.NotNil(t, err)
+}
+
+func TestPublishUsesTopicMapping(t *testing.T) {
+	producer := &fakePublishRecordingProducer{}
+	k := &Kafka{
+		producer: producer,
+		metadata: &kafkaMetadata{topicMapping: map[string]string{"orders": "orders-v2"}},
+	}
+
+	err := k.Publish(&pubsub.PublishRequest{Topic: "orders", Data: []byte("hi")})
+	assert.Nil(t, err)
+	assert.Equal(t, "orders-v2", producer.lastTopic)
+}
+
+func TestPublishFallsBackToPublishTopic(t *testing.T) {
+	producer := &fakePublishRecordingProducer{}
+	k := &Kafka{
+		producer: producer,
+		metadata: &kafkaMetadata{PublishTopic: "default-topic"},
+	}
+
+	err := k.Publish(&pubsub.PublishRequest{Data: []byte("hi")})
+	assert.Nil(t, err)
+	assert.Equal(t, "default-topic", producer.lastTopic)
+}
+
+func TestPublishWithoutTopicFails(t *testing.T) {
+	k := &Kafka{
+		producer: &fakePublishRecordingProducer{},
+		metadata: &kafkaMetadata{},
+	}
+
+	err := k.Publish(&pubsub.PublishRequest{Data: []byte("hi")})
+	assert.NotNil(t, err)
+}
+
+type fakePublishRecordingProducer struct {
+	lastTopic string
+	lastMsg   *sarama.ProducerMessage
+}
+
+func (f *fakePublishRecordingProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	f.lastTopic = msg.Topic
+	f.lastMsg = msg
+	return 0, 0, nil
+}
+func (f *fakePublishRecordingProducer) SendMessages(msgs []*sarama.ProducerMessage) error { return nil }
+func (f *fakePublishRecordingProducer) Close() error                                      { return nil }
+
+func TestParseMetadataWithSaslPlaintext(t *testing.T) {
+	m := pubsub.Metadata{}
+	m.Properties = map[string]string{
+		"consumerGroup": "a", "brokers": "a", "topics": "a",
+		"authRequired": "true", "saslUsername": "user", "saslPassword": "pass",
+	}
+	k := Kafka{}
+	meta, err := k.getKafkaMetadata(m)
+	assert.Nil(t, err)
+	assert.True(t, meta.AuthRequired)
+	assert.Equal(t, "user", meta.SaslUsername)
+	assert.Equal(t, "pass", meta.SaslPassword)
+	assert.Equal(t, saslMechanismPlaintext, meta.SaslMechanism)
+}
+
+func TestParseMetadataWithSaslScram(t *testing.T) {
+	m := pubsub.Metadata{}
+	m.Properties = map[string]string{
+		"consumerGroup": "a", "brokers": "a", "topics": "a",
+		"authRequired": "true", "saslUsername": "user", "saslPassword": "pass",
+		"saslMechanism": saslMechanismSCRAMSHA512,
+	}
+	k := Kafka{}
+	meta, err := k.getKafkaMetadata(m)
+	assert.Nil(t, err)
+	assert.Equal(t, saslMechanismSCRAMSHA512, meta.SaslMechanism)
+}
+
+func TestParseMetadataWithInvalidSaslMechanism(t *testing.T) {
+	m := pubsub.Metadata{}
+	m.Properties = map[string]string{
+		"consumerGroup": "a", "brokers": "a", "topics": "a",
+		"authRequired": "true", "saslUsername": "user", "saslPassword": "pass",
+		"saslMechanism": "not-a-mechanism",
+	}
+	k := Kafka{}
+	_, err := k.getKafkaMetadata(m)
+	assert.NotNil(t, err)
+}
+
+func TestParseMetadataAuthRequiredMissingCredentials(t *testing.T) {
+	m := pubsub.Metadata{}
+	m.Properties = map[string]string{
+		"consumerGroup": "a", "brokers": "a", "topics": "a",
+		"authRequired": "true",
+	}
+	k := Kafka{}
+	_, err := k.getKafkaMetadata(m)
+	assert.NotNil(t, err)
+}
+
+func TestParseMetadataWithTLS(t *testing.T) {
+	m := pubsub.Metadata{}
+	m.Properties = map[string]string{
+		"consumerGroup": "a", "brokers": "a", "topics": "a",
+		"tlsEnable": "true", "tlsSkipVerify": "true",
+	}
+	k := Kafka{}
+	meta, err := k.getKafkaMetadata(m)
+	assert.Nil(t, err)
+	assert.True(t, meta.TLSEnable)
+	assert.True(t, meta.TLSSkipVerify)
+}
+
+func TestParseMetadataDefaultsOffsetCheckSettings(t *testing.T) {
+	m := pubsub.Metadata{}
+	m.Properties = map[string]string{"consumerGroup": "a", "brokers": "a", "topics": "a"}
+	k := Kafka{}
+	meta, err := k.getKafkaMetadata(m)
+	assert.Nil(t, err)
+	assert.Equal(t, defaultOffsetCheckInterval, meta.offsetCheckInterval)
+	assert.Equal(t, defaultOffsetCheckTimeout, meta.offsetCheckTimeout)
+}
+
+func TestParseMetadataWithOffsetCheckSettings(t *testing.T) {
+	m := pubsub.Metadata{}
+	m.Properties = map[string]string{
+		"consumerGroup": "a", "brokers": "a", "topics": "a",
+		"offsetCheckInterval": "100ms", "offsetCheckTimeout": "5s",
+	}
+	k := Kafka{}
+	meta, err := k.getKafkaMetadata(m)
+	assert.Nil(t, err)
+	assert.Equal(t, 100*time.Millisecond, meta.offsetCheckInterval)
+	assert.Equal(t, 5*time.Second, meta.offsetCheckTimeout)
+}
+
+func TestParseMetadataWithInvalidOffsetCheckInterval(t *testing.T) {
+	m := pubsub.Metadata{}
+	m.Properties = map[string]string{
+		"consumerGroup": "a", "brokers": "a", "topics": "a",
+		"offsetCheckInterval": "not-a-duration",
+	}
+	k := Kafka{}
+	_, err := k.getKafkaMetadata(m)
+	assert.NotNil(t, err)
+}
+
+func TestConsumerSetupRunsOffsetCheckBeforeSignallingReady(t *testing.T) {
+	checked := make(chan struct{})
+	cs := &consumer{
+		ready: make(chan bool),
+		checkOffsets: func(client sarama.Client, group string, claims map[string][]int32, interval, timeout time.Duration) error {
+			close(checked)
+			return nil
+		},
+	}
+
+	err := cs.Setup(&fakeConsumerGroupSession{ctx: context.Background()})
+	assert.Nil(t, err)
+
+	select {
+	case <-checked:
+	default:
+		t.Fatal("expected checkOffsets to run during Setup")
+	}
+
+	select {
+	case <-cs.ready:
+	default:
+		t.Fatal("expected ready to be closed after a successful offset check")
+	}
+}
+
+func TestConsumerSetupPropagatesOffsetCheckError(t *testing.T) {
+	cs := &consumer{
+		ready: make(chan bool),
+		checkOffsets: func(client sarama.Client, group string, claims map[string][]int32, interval, timeout time.Duration) error {
+			return errors.New("timed out waiting for offsets")
+		},
+	}
+
+	err := cs.Setup(&fakeConsumerGroupSession{ctx: context.Background()})
+	assert.NotNil(t, err)
+
+	select {
+	case <-cs.ready:
+		t.Fatal("ready should not be closed when the offset check fails")
+	default:
+	}
+}
+
+func TestParseMetadataWithVersion(t *testing.T) {
+	m := pubsub.Metadata{}
+	m.Properties = map[string]string{
+		"consumerGroup": "a", "brokers": "a", "topics": "a",
+		"version": "2.0.0",
+	}
+	k := Kafka{}
+	meta, err := k.getKafkaMetadata(m)
+	assert.Nil(t, err)
+	assert.Equal(t, sarama.V2_0_0_0, meta.kafkaVersion)
+}
+
+func TestParseMetadataWithInvalidVersion(t *testing.T) {
+	m := pubsub.Metadata{}
+	m.Properties = map[string]string{
+		"consumerGroup": "a", "brokers": "a", "topics": "a",
+		"version": "not-a-version",
+	}
+	k := Kafka{}
+	_, err := k.getKafkaMetadata(m)
+	assert.NotNil(t, err)
+}
+
+// fakeConsumerGroup is a sarama.ConsumerGroup test double that drives a single
+// ConsumeClaim over one fake partition, then blocks until ctx is cancelled.
+type fakeConsumerGroup struct {
+	messages chan *sarama.ConsumerMessage
+	closed   bool
+}
+
+func (f *fakeConsumerGroup) Consume(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+	session := &fakeConsumerGroupSession{ctx: ctx}
+	if err := handler.Setup(session); err != nil {
+		return err
+	}
+	claim := &fakeConsumerGroupClaim{topic: topics[0], messages: f.messages}
+	go func() {
+		<-ctx.Done()
+		close(f.messages)
+	}()
+	if err := handler.ConsumeClaim(session, claim); err != nil {
+		return err
+	}
+	return handler.Cleanup(session)
+}
+
+func (f *fakeConsumerGroup) Errors() <-chan error { return nil }
+func (f *fakeConsumerGroup) Close() error {
+	f.closed = true
+	return nil
+}
+
+type fakeConsumerGroupSession struct {
+	ctx context.Context
+}
+
+func (s *fakeConsumerGroupSession) Claims() map[string][]int32                  { return nil }
+func (s *fakeConsumerGroupSession) MemberID() string                            { return "fake" }
+func (s *fakeConsumerGroupSession) GenerationID() int32                         { return 0 }
+func (s *fakeConsumerGroupSession) MarkOffset(string, int32, int64, string)     {}
+func (s *fakeConsumerGroupSession) ResetOffset(string, int32, int64, string)    {}
+func (s *fakeConsumerGroupSession) MarkMessage(*sarama.ConsumerMessage, string) {}
+func (s *fakeConsumerGroupSession) Context() context.Context                    { return s.ctx }
+
+type fakeConsumerGroupClaim struct {
+	topic    string
+	messages chan *sarama.ConsumerMessage
+}
+
+func (c *fakeConsumerGroupClaim) Topic() string                            { return c.topic }
+func (c *fakeConsumerGroupClaim) Partition() int32                         { return 0 }
+func (c *fakeConsumerGroupClaim) InitialOffset() int64                     { return 0 }
+func (c *fakeConsumerGroupClaim) HighWaterMarkOffset() int64               { return 0 }
+func (c *fakeConsumerGroupClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+type fakeSyncProducer struct{}
+
+func (f *fakeSyncProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	return 0, 0, nil
+}
+func (f *fakeSyncProducer) SendMessages(msgs []*sarama.ProducerMessage) error { return nil }
+func (f *fakeSyncProducer) Close() error                                     { return nil }
+
+func TestSubscribeEndToEnd(t *testing.T) {
+	received := make(chan string, 1)
+	fakeGroup := &fakeConsumerGroup{messages: make(chan *sarama.ConsumerMessage, 1)}
+	fakeGroup.messages <- &sarama.ConsumerMessage{Topic: "a", Value: []byte("hello")}
+
+	k := (&Kafka{
+		consumerGroup: "cg",
+		brokers:       []string{"a"},
+		metadata:      &kafkaMetadata{kafkaVersion: sarama.V1_0_0_0},
+	}).WithConsumerBuilder(func(brokers []string, group string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		return fakeGroup, nil
+	}).WithClientBuilder(func(brokers []string, config *sarama.Config) (sarama.Client, error) {
+		return nil, nil
+	})
+
+	err := k.Subscribe(pubsub.SubscribeRequest{Topic: "a"}, func(msg *pubsub.NewMessage) error {
+		received <- string(msg.Data)
+		return nil
+	})
+	assert.Nil(t, err)
+
+	select {
+	case msg := <-received:
+		assert.Equal(t, "hello", msg)
+	case <-time.After(time.Second):
+		t.Fatal("did not receive message")
+	}
+
+	assert.Nil(t, k.Close())
+}
+
+func TestSubscribeIsNonBlocking(t *testing.T) {
+	fakeGroup := &fakeConsumerGroup{messages: make(chan *sarama.ConsumerMessage)}
+
+	k := (&Kafka{
+		consumerGroup: "cg",
+		brokers:       []string{"a"},
+		metadata:      &kafkaMetadata{kafkaVersion: sarama.V1_0_0_0},
+	}).WithConsumerBuilder(func(brokers []string, group string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		return fakeGroup, nil
+	}).WithClientBuilder(func(brokers []string, config *sarama.Config) (sarama.Client, error) {
+		return nil, nil
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- k.Subscribe(pubsub.SubscribeRequest{Topic: "a"}, func(msg *pubsub.NewMessage) error { return nil })
+	}()
+
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Subscribe blocked instead of returning immediately")
+	}
+
+	assert.Nil(t, k.Close())
+}
+
+func TestSubscribeTwiceForSameTopicFails(t *testing.T) {
+	k := (&Kafka{
+		consumerGroup: "cg",
+		brokers:       []string{"a"},
+		metadata:      &kafkaMetadata{kafkaVersion: sarama.V1_0_0_0},
+	}).WithConsumerBuilder(func(brokers []string, group string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		return &fakeConsumerGroup{messages: make(chan *sarama.ConsumerMessage)}, nil
+	}).WithClientBuilder(func(brokers []string, config *sarama.Config) (sarama.Client, error) {
+		return nil, nil
+	})
+
+	err := k.Subscribe(pubsub.SubscribeRequest{Topic: "a"}, func(msg *pubsub.NewMessage) error { return nil })
+	assert.Nil(t, err)
+
+	err = k.Subscribe(pubsub.SubscribeRequest{Topic: "a"}, func(msg *pubsub.NewMessage) error { return nil })
+	assert.NotNil(t, err)
+
+	assert.Nil(t, k.Close())
+}
+
+// fakeFailingOffsetClient's Coordinator call fails, driving Setup's offset
+// check into its error path without a real broker connection.
+type fakeFailingOffsetClient struct {
+	closed bool
+}
+
+func (f *fakeFailingOffsetClient) Config() *sarama.Config {
+	return sarama.NewConfig()
+}
+
+func (f *fakeFailingOffsetClient) Controller() (*sarama.Broker, error) {
+	return nil, nil
+}
+
+func (f *fakeFailingOffsetClient) Brokers() []*sarama.Broker {
+	return nil
+}
+
+func (f *fakeFailingOffsetClient) Topics() ([]string, error) {
+	return nil, nil
+}
+
+func (f *fakeFailingOffsetClient) Partitions(topic string) ([]int32, error) {
+	return nil, nil
+}
+
+func (f *fakeFailingOffsetClient) WritablePartitions(topic string) ([]int32, error) {
+	return nil, nil
+}
+
+func (f *fakeFailingOffsetClient) Leader(topic string, partitionID int32) (*sarama.Broker, error) {
+	return nil, nil
+}
+
+func (f *fakeFailingOffsetClient) Replicas(topic string, partitionID int32) ([]int32, error) {
+	return nil, nil
+}
+
+func (f *fakeFailingOffsetClient) InSyncReplicas(topic string, partitionID int32) ([]int32, error) {
+	return nil, nil
+}
+
+func (f *fakeFailingOffsetClient) OfflineReplicas(topic string, partitionID int32) ([]int32, error) {
+	return nil, nil
+}
+
+func (f *fakeFailingOffsetClient) RefreshBrokers(addrs []string) error {
+	return nil
+}
+
+func (f *fakeFailingOffsetClient) RefreshMetadata(topics ...string) error {
+	return nil
+}
+
+func (f *fakeFailingOffsetClient) GetOffset(topic string, partitionID int32, time int64) (int64, error) {
+	return 0, nil
+}
+
+func (f *fakeFailingOffsetClient) Coordinator(consumerGroup string) (*sarama.Broker, error) {
+	return nil, errors.New("no coordinator available")
+}
+
+func (f *fakeFailingOffsetClient) RefreshCoordinator(consumerGroup string) error {
+	return nil
+}
+
+func (f *fakeFailingOffsetClient) InitProducerID() (*sarama.InitProducerIDResponse, error) {
+	return nil, nil
+}
+
+func (f *fakeFailingOffsetClient) Close() error {
+	f.closed = true
+	return nil
+}
+
+func (f *fakeFailingOffsetClient) Closed() bool {
+	return f.closed
+}
+
+func TestSubscribeReturnsErrorAndClosesClientsWhenOffsetCheckFails(t *testing.T) {
+	fakeGroup := &fakeConsumerGroup{messages: make(chan *sarama.ConsumerMessage)}
+	fakeClient := &fakeFailingOffsetClient{}
+
+	k := (&Kafka{
+		consumerGroup: "cg",
+		brokers:       []string{"a"},
+		metadata: &kafkaMetadata{
+			kafkaVersion:        sarama.V1_0_0_0,
+			offsetCheckInterval: time.Millisecond,
+			offsetCheckTimeout:  50 * time.Millisecond,
+		},
+	}).WithConsumerBuilder(func(brokers []string, group string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		return fakeGroup, nil
+	}).WithClientBuilder(func(brokers []string, config *sarama.Config) (sarama.Client, error) {
+		return fakeClient, nil
+	})
+
+	err := k.Subscribe(pubsub.SubscribeRequest{Topic: "a"}, func(msg *pubsub.NewMessage) error { return nil })
+	assert.NotNil(t, err)
+
+	assert.True(t, fakeGroup.closed)
+	assert.True(t, fakeClient.closed)
+
+	assert.Nil(t, k.Close())
+}
+
+func TestParseMetadataClientCertRequiresKey(t *testing.T) {
+	m := pubsub.Metadata{}
+	m.Properties = map[string]string{
+		"consumerGroup": "a", "brokers": "a", "topics": "a",
+		"tlsEnable": "true", "clientCert": "cert-only",
+	}
+	k := Kafka{}
+	_, err := k.getKafkaMetadata(m)
+	assert.NotNil(t, err)
+}
+
+func TestInitRequiresBrokers(t *testing.T) {
+	m := pubsub.Metadata{}
+	m.Properties = map[string]string{"consumerGroup": "a", "topics": "a"}
+	k := Kafka{}
+	err := k.Init(m)
+	assert.NotNil(t, err)
+}
+
+func TestParseMetadataWithPartitionerRequiredAcksAndCompression(t *testing.T) {
+	m := pubsub.Metadata{}
+	m.Properties = map[string]string{
+		"consumerGroup": "a", "brokers": "a", "topics": "a",
+		"partitioner": partitionerManual, "requiredAcks": requiredAcksLocal,
+		"maxMessageBytes": "2048", "compression": "gzip",
+	}
+	k := Kafka{}
+	meta, err := k.getKafkaMetadata(m)
+	assert.Nil(t, err)
+	assert.Equal(t, partitionerManual, meta.Partitioner)
+	assert.Equal(t, requiredAcksLocal, meta.RequiredAcks)
+	assert.Equal(t, "2048", meta.MaxMessageBytes)
+	assert.Equal(t, "gzip", meta.Compression)
+}
+
+func TestParseMetadataWithInvalidPartitioner(t *testing.T) {
+	m := pubsub.Metadata{}
+	m.Properties = map[string]string{
+		"consumerGroup": "a", "brokers": "a", "topics": "a",
+		"partitioner": "not-a-partitioner",
+	}
+	k := Kafka{}
+	_, err := k.getKafkaMetadata(m)
+	assert.NotNil(t, err)
+}
+
+func TestParseMetadataWithInvalidRequiredAcks(t *testing.T) {
+	m := pubsub.Metadata{}
+	m.Properties = map[string]string{
+		"consumerGroup": "a", "brokers": "a", "topics": "a",
+		"requiredAcks": "not-a-value",
+	}
+	k := Kafka{}
+	_, err := k.getKafkaMetadata(m)
+	assert.NotNil(t, err)
+}
+
+func TestParseMetadataWithInvalidMaxMessageBytes(t *testing.T) {
+	m := pubsub.Metadata{}
+	m.Properties = map[string]string{
+		"consumerGroup": "a", "brokers": "a", "topics": "a",
+		"maxMessageBytes": "not-a-number",
+	}
+	k := Kafka{}
+	_, err := k.getKafkaMetadata(m)
+	assert.NotNil(t, err)
+}
+
+func TestParseMetadataWithInvalidCompression(t *testing.T) {
+	m := pubsub.Metadata{}
+	m.Properties = map[string]string{
+		"consumerGroup": "a", "brokers": "a", "topics": "a",
+		"compression": "not-a-codec",
+	}
+	k := Kafka{}
+	_, err := k.getKafkaMetadata(m)
+	assert.NotNil(t, err)
+}
+
+func TestUpdateProducerConfigAppliesSettings(t *testing.T) {
+	meta := &kafkaMetadata{
+		Partitioner:     partitionerRoundRobin,
+		RequiredAcks:    requiredAcksNone,
+		MaxMessageBytes: "4096",
+		Compression:     "snappy",
+	}
+	config := sarama.NewConfig()
+	err := updateProducerConfig(config, meta)
+	assert.Nil(t, err)
+	assert.Equal(t, sarama.NoResponse, config.Producer.RequiredAcks)
+	assert.Equal(t, 4096, config.Producer.MaxMessageBytes)
+	assert.Equal(t, sarama.CompressionSnappy, config.Producer.Compression)
+}
+
+func TestUpdateAuthInfoSkipsWhenNotRequired(t *testing.T) {
+	meta := &kafkaMetadata{}
+	config := sarama.NewConfig()
+	err := updateAuthInfo(config, meta)
+	assert.Nil(t, err)
+	assert.False(t, config.Net.SASL.Enable)
+}
+
+func TestUpdateAuthInfoAppliesPlaintextSettings(t *testing.T) {
+	meta := &kafkaMetadata{
+		AuthRequired:  true,
+		SaslUsername:  "user",
+		SaslPassword:  "pass",
+		SaslMechanism: saslMechanismPlaintext,
+	}
+	config := sarama.NewConfig()
+	err := updateAuthInfo(config, meta)
+	assert.Nil(t, err)
+	assert.True(t, config.Net.SASL.Enable)
+	assert.Equal(t, "user", config.Net.SASL.User)
+	assert.Equal(t, "pass", config.Net.SASL.Password)
+	assert.Equal(t, sarama.SASLTypePlaintext, config.Net.SASL.Mechanism)
+}
+
+func TestUpdateAuthInfoAppliesScramSettings(t *testing.T) {
+	meta := &kafkaMetadata{
+		AuthRequired:  true,
+		SaslUsername:  "user",
+		SaslPassword:  "pass",
+		SaslMechanism: saslMechanismSCRAMSHA256,
+	}
+	config := sarama.NewConfig()
+	err := updateAuthInfo(config, meta)
+	assert.Nil(t, err)
+	assert.Equal(t, sarama.SASLTypeSCRAMSHA256, config.Net.SASL.Mechanism)
+	assert.NotNil(t, config.Net.SASL.SCRAMClientGeneratorFunc)
+}
+
+// generateTestCert returns a self-signed certificate/key pair in PEM form,
+// good enough to exercise updateTLSConfig's parsing without a real CA.
+func generateTestCert(t *testing.T) (certPEM, keyPEM string) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "kafka-test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+
+	certPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	keyPEM = string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+	return certPEM, keyPEM
+}
+
+func TestUpdateTLSConfigSkipsWhenDisabled(t *testing.T) {
+	meta := &kafkaMetadata{}
+	config := sarama.NewConfig()
+	err := updateTLSConfig(config, meta)
+	assert.Nil(t, err)
+	assert.False(t, config.Net.TLS.Enable)
+}
+
+func TestUpdateTLSConfigAppliesCaCertAndSkipVerify(t *testing.T) {
+	caCert, _ := generateTestCert(t)
+	meta := &kafkaMetadata{TLSEnable: true, TLSSkipVerify: true, CaCert: caCert}
+	config := sarama.NewConfig()
+	err := updateTLSConfig(config, meta)
+	assert.Nil(t, err)
+	assert.True(t, config.Net.TLS.Enable)
+	assert.NotNil(t, config.Net.TLS.Config)
+	assert.True(t, config.Net.TLS.Config.InsecureSkipVerify)
+	assert.NotNil(t, config.Net.TLS.Config.RootCAs)
+}
+
+func TestUpdateTLSConfigAppliesClientCertificate(t *testing.T) {
+	certPEM, keyPEM := generateTestCert(t)
+	meta := &kafkaMetadata{TLSEnable: true, ClientCert: certPEM, ClientKey: keyPEM}
+	config := sarama.NewConfig()
+	err := updateTLSConfig(config, meta)
+	assert.Nil(t, err)
+	assert.Len(t, config.Net.TLS.Config.Certificates, 1)
+}
+
+func TestPublishSetsKeyPartitionAndCloudEventHeaders(t *testing.T) {
+	producer := &fakePublishRecordingProducer{}
+	k := &Kafka{
+		producer: producer,
+		metadata: &kafkaMetadata{},
+	}
+
+	err := k.Publish(&pubsub.PublishRequest{
+		Topic: "orders",
+		Data:  []byte("hi"),
+		Metadata: map[string]string{
+			"key":        "order-1",
+			"partition":  "2",
+			"ce_type":    "order.created",
+			"unprefixed": "ignored",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, sarama.StringEncoder("order-1"), producer.lastMsg.Key)
+	assert.Equal(t, int32(2), producer.lastMsg.Partition)
+	assert.Equal(t, []sarama.RecordHeader{{Key: []byte("ce_type"), Value: []byte("order.created")}}, producer.lastMsg.Headers)
+}
+
+func TestPublishWithInvalidPartitionFails(t *testing.T) {
+	producer := &fakePublishRecordingProducer{}
+	k := &Kafka{
+		producer: producer,
+		metadata: &kafkaMetadata{},
+	}
+
+	err := k.Publish(&pubsub.PublishRequest{
+		Topic:    "orders",
+		Data:     []byte("hi"),
+		Metadata: map[string]string{"partition": "not-a-number"},
+	})
+	assert.NotNil(t, err)
+}
+
+func TestRecordMetadataIncludesKeyPartitionOffsetAndHeaders(t *testing.T) {
+	message := &sarama.ConsumerMessage{
+		Key:       []byte("order-1"),
+		Partition: 3,
+		Offset:    42,
+		Headers:   []*sarama.RecordHeader{{Key: []byte("ce_type"), Value: []byte("order.created")}},
+	}
+
+	metadata := recordMetadata(message)
+	assert.Equal(t, "order-1", metadata[metadataKeyField])
+	assert.Equal(t, "3", metadata[metadataPartitionField])
+	assert.Equal(t, "42", metadata["offset"])
+	assert.Equal(t, "order.created", metadata["ce_type"])
+}
+
+func TestConsumeClaimForwardsRecordMetadata(t *testing.T) {
+	messages := make(chan *sarama.ConsumerMessage, 1)
+	messages <- &sarama.ConsumerMessage{Topic: "a", Value: []byte("hi"), Key: []byte("order-1"), Partition: 1}
+	close(messages)
+
+	var received *pubsub.NewMessage
+	cs := &consumer{
+		ready: make(chan bool),
+		callback: func(msg *pubsub.NewMessage) error {
+			received = msg
+			return nil
+		},
+	}
+
+	claim := &fakeConsumerGroupClaim{topic: "a", messages: messages}
+	err := cs.ConsumeClaim(&fakeConsumerGroupSession{ctx: context.Background()}, claim)
+	assert.Nil(t, err)
+	assert.NotNil(t, received)
+	assert.Equal(t, "order-1", received.Metadata[metadataKeyField])
+	assert.Equal(t, "1", received.Metadata[metadataPartitionField])
+}